@@ -1,26 +1,484 @@
 package hmap
 
 import (
+	"encoding/binary"
 	"hash/maphash"
-	"maps"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 const (
 	defaultShardCount = 1 << 6 // 64
 )
 
-type mapItem[V any] struct {
+// Hasher 决定 Map 如何把 key 映射到分片与桶位，实现必须保证相同 seed 下
+// 同一个 key 始终返回相同的哈希值。New 会在没有通过 WithHasher 指定时，
+// 为 string 与内置整数类型自动选用下面的默认实现；固定大小的数组类型
+// （如 [16]byte UUID）需要显式传入 WithHasher(BytesHasher[K]{})，其它 key
+// 类型同样必须显式传入 Hasher，否则 New 会 panic。
+type Hasher[K comparable] interface {
+	Hash(seed maphash.Seed, key K) uint64
+}
+
+// StringHasher 是 string 类型 key 的默认 Hasher
+type StringHasher struct{}
+
+func (StringHasher) Hash(seed maphash.Seed, key string) uint64 {
+	return maphash.String(seed, key)
+}
+
+// Integer 约束涵盖全部内置整数类型，供 IntHasher 使用
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntHasher 是整数类型 key 的默认 Hasher，把 key 按小端序写入 8 字节后交给
+// maphash.Bytes，避免 strconv/string 转换带来的额外分配
+type IntHasher[K Integer] struct{}
+
+func (IntHasher[K]) Hash(seed maphash.Seed, key K) uint64 {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(key))
+	return maphash.Bytes(seed, buf[:])
+}
+
+// BytesHasher 是固定大小数组 key（例如 [16]byte UUID）推荐搭配的 Hasher，
+// 直接对 key 的原始内存表示做哈希；New 不会为数组类型自动选用它，需要通过
+// WithHasher(BytesHasher[K]{}) 显式指定。仅适用于不含指针/接口/切片等引用
+// 字段的 key 类型，否则哈希的是引用地址而非内容，应改用 WithHasher 传入
+// 自定义实现。
+type BytesHasher[K comparable] struct{}
+
+func (BytesHasher[K]) Hash(seed maphash.Seed, key K) uint64 {
+	b := unsafe.Slice((*byte)(unsafe.Pointer(&key)), unsafe.Sizeof(key))
+	return maphash.Bytes(seed, b)
+}
+
+// defaultHasher 为常见 key 类型自动选择 Hasher；K 不在已知类型之列时返回 nil，
+// 调用方必须通过 WithHasher 显式指定
+func defaultHasher[K comparable]() Hasher[K] {
+	var zero K
+	switch any(zero).(type) {
+	case string:
+		return any(StringHasher{}).(Hasher[K])
+	case int:
+		return any(IntHasher[int]{}).(Hasher[K])
+	case int8:
+		return any(IntHasher[int8]{}).(Hasher[K])
+	case int16:
+		return any(IntHasher[int16]{}).(Hasher[K])
+	case int32:
+		return any(IntHasher[int32]{}).(Hasher[K])
+	case int64:
+		return any(IntHasher[int64]{}).(Hasher[K])
+	case uint:
+		return any(IntHasher[uint]{}).(Hasher[K])
+	case uint8:
+		return any(IntHasher[uint8]{}).(Hasher[K])
+	case uint16:
+		return any(IntHasher[uint16]{}).(Hasher[K])
+	case uint32:
+		return any(IntHasher[uint32]{}).(Hasher[K])
+	case uint64:
+		return any(IntHasher[uint64]{}).(Hasher[K])
+	case uintptr:
+		return any(IntHasher[uintptr]{}).(Hasher[K])
+	default:
+		return nil
+	}
+}
+
+// entry 是分片内单个 key 对应的值容器，p 为 nil 表示该 key 已被删除（墓碑），
+// p 等于分片的 expunged 哨兵表示该墓碑已确认不存在于 dirty 中，可在下一次
+// dirty 重建时跳过。p 本身的读写全部通过原子操作完成，不依赖分片锁，因此
+// Rebalance 复用 expunged 哨兵表达第二种含义："正在被搬迁"（见
+// freezeLocked）：快路径的 CAS 在撞见 expunged 时无法区分这两种情况，必
+// 须回退到锁路径，由 mapItem.retired 消歧到底是遇上了旧墓碑还是正在搬迁。
+type entry[V any] struct {
+	p atomic.Pointer[V]
+}
+
+func newEntry[V any](value V) *entry[V] {
+	e := &entry[V]{}
+	e.p.Store(&value)
+	return e
+}
+
+// load 无锁读取当前值；entry 已删除或已 expunged 时返回 ok=false
+func (e *entry[V]) load(expunged *V) (value V, ok bool) {
+	p := e.p.Load()
+	if p == nil || p == expunged {
+		return value, false
+	}
+	return *p, true
+}
+
+// tryStore 在 entry 未被 expunged 的前提下无锁 CAS 更新值，entry 处于
+// 墓碑态（p == nil）时仍可直接覆盖；只有 expunged 态需要回退到加锁路径
+func (e *entry[V]) tryStore(expunged *V, value V) bool {
+	for {
+		p := e.p.Load()
+		if p == expunged {
+			return false
+		}
+		if e.p.CompareAndSwap(p, &value) {
+			return true
+		}
+	}
+}
+
+// storeLocked 在持有分片锁时直接写入，无需 CAS
+func (e *entry[V]) storeLocked(value V) {
+	e.p.Store(&value)
+}
+
+// unexpungeLocked 把 expunged 态的 entry 恢复为墓碑态，返回是否发生了恢复；
+// 调用方需要在恢复成功后把该 entry 重新登记进 dirty
+func (e *entry[V]) unexpungeLocked(expunged *V) bool {
+	return e.p.CompareAndSwap(expunged, nil)
+}
+
+// tryExpungeLocked 把墓碑态 entry 标记为 expunged，返回标记后 entry 是否已
+// 处于 expunged 态（包括调用前已是 expunged 的情况）
+func (e *entry[V]) tryExpungeLocked(expunged *V) bool {
+	p := e.p.Load()
+	for p == nil {
+		if e.p.CompareAndSwap(nil, expunged) {
+			return true
+		}
+		p = e.p.Load()
+	}
+	return p == expunged
+}
+
+// tombstone 无锁地把 entry 标记为删除，返回删除前的值
+func (e *entry[V]) tombstone(expunged *V) (value V, ok bool) {
+	for {
+		p := e.p.Load()
+		if p == nil || p == expunged {
+			return value, false
+		}
+		if e.p.CompareAndSwap(p, nil) {
+			return *p, true
+		}
+	}
+}
+
+// isExpunged 无锁地判断 entry 当前是否处于 expunged 态
+func (e *entry[V]) isExpunged(expunged *V) bool {
+	return e.p.Load() == expunged
+}
+
+// freezeLocked 把 entry 原子地标记为 expunged 并捕获标记前一刻的值，供
+// Rebalance 搬迁 entry 时使用；调用方必须持有分片锁。墓碑 entry 同样会被
+// 标记为 expunged，使旧分片上的无锁写入无法直接覆盖它。entry 本就是墓碑或
+// 已被 expunged 时返回 ok=false，表示没有需要搬迁的值。
+func (e *entry[V]) freezeLocked(expunged *V) (value V, ok bool) {
+	for {
+		p := e.p.Load()
+		if p == expunged {
+			return value, false
+		}
+		if e.p.CompareAndSwap(p, expunged) {
+			if p == nil {
+				return value, false
+			}
+			return *p, true
+		}
+	}
+}
+
+// deleteIf 无锁地在满足 delIf 的前提下把 entry 标记为删除；CAS 失败（值被
+// 其它写入者抢先修改）时会用最新值重新评估 delIf
+func (e *entry[V]) deleteIf(expunged *V, delIf func(V) bool) bool {
+	for {
+		p := e.p.Load()
+		if p == nil || p == expunged {
+			return false
+		}
+		if !delIf(*p) {
+			return false
+		}
+		if e.p.CompareAndSwap(p, nil) {
+			return true
+		}
+	}
+}
+
+// readOnly 是某个分片的只读快照，可在无锁状态下被任意数量的读者并发访问。
+// amended 为 true 表示 dirty 中存在快照里没有的 key，读取未命中时需要落到
+// dirty 路径。
+type readOnly[K comparable, V any] struct {
+	m       map[K]*entry[V]
+	amended bool
+}
+
+// mapItem 是单个分片，采用类似 sync.Map 的 read/dirty 双层结构：
+// read 是原子发布的只读快照，读多写少场景下 Get 完全无锁；dirty 是受
+// RWMutex 保护的可变全量视图，只有在快照未命中且确实存在分叉时才会用到。
+// missCount 记录快照未命中落到 dirty 的次数，达到阈值后把 dirty 提升为新的
+// read 快照并清零计数，使热点 key 集合稳定后的读路径重新回到无锁状态。
+// retired 在分片被 Rebalance 整体迁移走之后置位；分片锁释放后仍然拿到这把
+// 锁的调用方（无论是无锁快路径回退来的，还是本就走锁路径的 Compute 之类）
+// 都必须检查它，一旦为 true 就说明自己操作的已经是个被丢弃的旧分片，必须
+// 回到 Map 重新加载最新的分片拓扑后重试，而不是信任/写入这个分片的数据。
+type mapItem[K comparable, V any] struct {
 	sync.RWMutex
-	data map[string]V
-	_    [32]byte // padding to avoid false sharing
+	read      atomic.Pointer[readOnly[K, V]]
+	dirty     map[K]*entry[V]
+	missCount int
+	expunged  *V
+	retired   atomic.Bool
+	_         [8]byte // padding to avoid false sharing
+}
+
+func newMapItem[K comparable, V any]() *mapItem[K, V] {
+	mi := &mapItem[K, V]{expunged: new(V)}
+	mi.read.Store(&readOnly[K, V]{m: make(map[K]*entry[V])})
+	return mi
+}
+
+// missLocked 必须在持有分片锁时调用；未命中次数达到 dirty 大小后，把 dirty
+// 原子地提升为新的 read 快照，并重置 dirty 与计数
+func (mi *mapItem[K, V]) missLocked() {
+	mi.missCount++
+	if mi.missCount < len(mi.dirty) {
+		return
+	}
+	mi.read.Store(&readOnly[K, V]{m: mi.dirty})
+	mi.dirty = nil
+	mi.missCount = 0
+}
+
+// dirtyLocked 确保 dirty 非空，必要时从当前 read 快照复制构建；复制过程中
+// 顺带把快照里的墓碑 entry 标记为 expunged 并跳过，使其不再进入新的 dirty，
+// 从而让快照本身无需在每次删除时重建即可逐步回收墓碑内存。
+func (mi *mapItem[K, V]) dirtyLocked() {
+	if mi.dirty != nil {
+		return
+	}
+	read := mi.read.Load()
+	mi.dirty = make(map[K]*entry[V], len(read.m))
+	for k, e := range read.m {
+		if !e.tryExpungeLocked(mi.expunged) {
+			mi.dirty[k] = e
+		}
+	}
+}
+
+// store 写路径：read 快照命中且未 expunged 时走无锁 CAS，否则回退到加锁的
+// 慢路径，按需把 key 写入 dirty 并在首次分叉时把 dirty 从 read 复制出来。
+// 返回 false 表示这个分片已经在一次 Rebalance 中被整体迁移走（retired），
+// 调用方需要重新从 Map 加载最新的分片拓扑后重试，而不是信任这次调用的结
+// 果——旧分片上的这次写入随时可能被丢弃。
+func (mi *mapItem[K, V]) store(key K, value V) bool {
+	read := mi.read.Load()
+	if e, ok := read.m[key]; ok {
+		if e.tryStore(mi.expunged, value) {
+			return true
+		}
+	}
+
+	mi.Lock()
+	defer mi.Unlock()
+	if mi.retired.Load() {
+		return false
+	}
+	mi.setLocked(key, value)
+	return true
+}
+
+// setIfAbsent 是 SetWithNotExist 的分片实现：已存在有效值时直接返回，
+// 否则在锁内创建/复活 entry 并写入。retired=true 的含义与 store 一致。
+func (mi *mapItem[K, V]) setIfAbsent(key K, value V) (v V, created bool, retired bool) {
+	read := mi.read.Load()
+	if e, ok := read.m[key]; ok {
+		if v, ok := e.load(mi.expunged); ok {
+			return v, false, false
+		}
+	}
+
+	mi.Lock()
+	defer mi.Unlock()
+	if mi.retired.Load() {
+		return value, false, true
+	}
+	if v, ok := mi.getLocked(key); ok {
+		return v, false, false
+	}
+	mi.setLocked(key, value)
+	return value, true, false
+}
+
+// getLocked 要求调用方已持有分片锁，从 read 快照或 dirty 中读取 key 当前值，
+// 供 Compute/UpsertIf 这类需要在锁内读取旧值的操作使用
+func (mi *mapItem[K, V]) getLocked(key K) (value V, ok bool) {
+	read := mi.read.Load()
+	if e, ok := read.m[key]; ok {
+		return e.load(mi.expunged)
+	}
+	if mi.dirty != nil {
+		if e, ok := mi.dirty[key]; ok {
+			return e.load(mi.expunged)
+		}
+	}
+	return value, false
+}
+
+// setLocked 要求调用方已持有分片锁，写入或创建 key 对应的值；与无锁的 store
+// 共用晋升/expunged 处理逻辑，供 Compute/UpsertIf 复用
+func (mi *mapItem[K, V]) setLocked(key K, value V) {
+	read := mi.read.Load()
+	if e, ok := read.m[key]; ok {
+		if e.unexpungeLocked(mi.expunged) && mi.dirty != nil {
+			mi.dirty[key] = e
+		}
+		e.storeLocked(value)
+		return
+	}
+	if mi.dirty != nil {
+		if e, ok := mi.dirty[key]; ok {
+			e.storeLocked(value)
+			return
+		}
+	}
+	if !read.amended {
+		mi.dirtyLocked()
+		mi.read.Store(&readOnly[K, V]{m: read.m, amended: true})
+	}
+	mi.dirty[key] = newEntry(value)
+}
+
+// deleteLocked 要求调用方已持有分片锁，删除 key 对应的值并返回删除前的值，
+// 供 Compute 在回调内决定移除时使用
+func (mi *mapItem[K, V]) deleteLocked(key K) (value V, ok bool) {
+	read := mi.read.Load()
+	if e, ok := read.m[key]; ok {
+		return e.tombstone(mi.expunged)
+	}
+	if mi.dirty != nil {
+		if e, ok := mi.dirty[key]; ok {
+			return e.tombstone(mi.expunged)
+		}
+	}
+	return value, false
+}
+
+// load 是 Get/GetWithDefault 的分片实现。read 快照未命中或撞见 expunged
+// 时回退到锁内经由 dirty 重新确认，并按 miss 次数触发晋升。retired=true
+// 的含义与 store 一致。
+func (mi *mapItem[K, V]) load(key K) (value V, ok bool, retired bool) {
+	read := mi.read.Load()
+	if e, found := read.m[key]; found {
+		if v, loaded := e.load(mi.expunged); loaded {
+			return v, true, false
+		}
+		if !e.isExpunged(mi.expunged) {
+			return value, false, false
+		}
+	} else if !read.amended {
+		return value, false, false
+	}
+
+	mi.Lock()
+	defer mi.Unlock()
+	if mi.retired.Load() {
+		return value, false, true
+	}
+	read = mi.read.Load()
+	if e, found := read.m[key]; found {
+		v, loaded := e.load(mi.expunged)
+		return v, loaded, false
+	}
+	if read.amended {
+		e, found := mi.dirty[key]
+		mi.missLocked()
+		if found {
+			v, loaded := e.load(mi.expunged)
+			return v, loaded, false
+		}
+	}
+	return value, false, false
+}
+
+// delete 是 Map.Delete 的分片实现：快路径对 read 快照里的 entry 尝试无锁
+// tombstone，CAS 失败时回退到锁内经由 dirty 重新确认。retired=true 的含
+// 义与 store 一致。
+func (mi *mapItem[K, V]) delete(key K) (value V, ok bool, retired bool) {
+	read := mi.read.Load()
+	if e, found := read.m[key]; found {
+		if v, deleted := e.tombstone(mi.expunged); deleted {
+			return v, true, false
+		}
+	} else if !read.amended {
+		return value, false, false
+	}
+
+	mi.Lock()
+	defer mi.Unlock()
+	if mi.retired.Load() {
+		return value, false, true
+	}
+	v, ok2 := mi.deleteLocked(key)
+	return v, ok2, false
+}
+
+// deleteIf 是 Map.DeleteIf 的分片实现：快路径 CAS 因 delIf 拒绝而失败时
+// 直接按"未删除"返回，不需要加锁；只有撞见 expunged，或 key 不在已分叉的
+// read 快照中时，才回退到锁内用当前值重新评估 delIf。retired=true 的含义
+// 与 store 一致。
+func (mi *mapItem[K, V]) deleteIf(key K, delIf func(V) bool) (ok bool, retired bool) {
+	read := mi.read.Load()
+	if e, found := read.m[key]; found {
+		if e.deleteIf(mi.expunged, delIf) {
+			return true, false
+		}
+		if !e.isExpunged(mi.expunged) {
+			return false, false
+		}
+	} else if !read.amended {
+		return false, false
+	}
+
+	mi.Lock()
+	defer mi.Unlock()
+	if mi.retired.Load() {
+		return false, true
+	}
+	v, exists := mi.getLocked(key)
+	if !exists || !delIf(v) {
+		return false, false
+	}
+	mi.deleteLocked(key)
+	return true, false
+}
+
+// effective 返回分片当前权威的 key/entry 视图：存在分叉时是 dirty，否则是
+// read 快照；调用方至少要持有 RLock
+func (mi *mapItem[K, V]) effective() map[K]*entry[V] {
+	if mi.dirty != nil {
+		return mi.dirty
+	}
+	return mi.read.Load().m
+}
+
+// shardTable 是 Map 某一时刻的分片拓扑：分片数组与对应的哈希 seed 必须
+// 配套使用（seed 变化意味着同一个 key 会落到不同分片），因此两者总是一起
+// 被原子地替换，调用方在一次操作内只应 Load 一次并复用同一份 table。
+type shardTable[K comparable, V any] struct {
+	datas []*mapItem[K, V]
+	seed  maphash.Seed
 }
 
 // Map字段名首字母均小写，避免外部使用时跳过New()函数使用结构体创建对象
 // 所有字段均为指针类型，避免外部修改结构体字段或数据复制导致数据不一致
-type Map[V any] struct {
-	datas []*mapItem[V]
-	seed  *maphash.Seed
+type Map[K comparable, V any] struct {
+	table       atomic.Pointer[shardTable[K, V]]
+	hasher      Hasher[K]
+	rebalanceMu sync.Mutex
 }
 
 func trueShards(shardCount int) int {
@@ -40,139 +498,267 @@ func trueShards(shardCount int) int {
 	return n + 1
 }
 
-func New[V any](inShardCount ...int) *Map[V] {
-	shardCount := defaultShardCount
-	if len(inShardCount) > 0 {
-		shardCount = trueShards(inShardCount[0])
+// options 收集 New 的功能性选项
+type options[K comparable, V any] struct {
+	shardCount int
+	hasher     Hasher[K]
+}
+
+// Option 是传给 New 的功能性选项
+type Option[K comparable, V any] func(*options[K, V])
+
+// WithShardCount 覆盖默认分片数（64），会被向上取整到最近的 2 的幂次
+func WithShardCount[K comparable, V any](shardCount int) Option[K, V] {
+	return func(o *options[K, V]) {
+		o.shardCount = shardCount
+	}
+}
+
+// WithHasher 替换 key 的 Hasher，用于 string/整数之外的 key 类型（固定大小
+// 数组可传入 BytesHasher[K]{}），或需要自定义哈希逻辑的场景
+func WithHasher[K comparable, V any](hasher Hasher[K]) Option[K, V] {
+	return func(o *options[K, V]) {
+		o.hasher = hasher
+	}
+}
+
+// New 创建一个按 key 哈希分片的并发安全 Map。K 为 string 或内置整数类型时
+// 会自动选用对应的默认 Hasher；固定大小数组（如 [16]byte UUID）等其它 key
+// 类型必须通过 WithHasher 显式指定（数组类型可以直接用 BytesHasher[K]{}），
+// 否则 New 会 panic。
+func New[K comparable, V any](opts ...Option[K, V]) *Map[K, V] {
+	o := options[K, V]{shardCount: defaultShardCount}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	shardCount := trueShards(o.shardCount)
+
+	hasher := o.hasher
+	if hasher == nil {
+		hasher = defaultHasher[K]()
+	}
+	if hasher == nil {
+		panic("hmap: no default Hasher for this key type, supply one with hmap.WithHasher")
 	}
 
 	seed := maphash.MakeSeed()
-	m := &Map[V]{
-		seed:  &seed,
-		datas: make([]*mapItem[V], shardCount),
+	m := &Map[K, V]{
+		hasher: hasher,
 	}
-	for i := range m.datas {
-		m.datas[i] = &mapItem[V]{
-			data: make(map[string]V),
-		}
+	datas := make([]*mapItem[K, V], shardCount)
+	for i := range datas {
+		datas[i] = newMapItem[K, V]()
 	}
+	m.table.Store(&shardTable[K, V]{datas: datas, seed: seed})
 	return m
 }
 
-func (m *Map[V]) getIndex(key string) int {
-	hash := maphash.String(*m.seed, key)
-	return int(hash & uint64(len(m.datas)-1))
+// getIndex 加载当前分片拓扑并返回 key 对应的分片序号；调用方应复用返回的
+// table，不要在同一次操作内再次 Load，避免 Rebalance 并发替换拓扑导致前后
+// 两次计算出的分片不一致。
+func (m *Map[K, V]) getIndex(table *shardTable[K, V], key K) int {
+	hash := m.hasher.Hash(table.seed, key)
+	return int(hash & uint64(len(table.datas)-1))
 }
 
-func (m *Map[V]) Set(key string, value V) {
-	index := m.getIndex(key)
-	m.datas[index].Lock()
-	defer m.datas[index].Unlock()
-	m.datas[index].data[key] = value
+// Set 在目标分片被并发 Rebalance 迁移走时会自动对最新的分片拓扑重试，
+// 调用方始终能观察到写入生效。
+func (m *Map[K, V]) Set(key K, value V) {
+	for {
+		table := m.table.Load()
+		index := m.getIndex(table, key)
+		if table.datas[index].store(key, value) {
+			return
+		}
+	}
 }
 
-func (m *Map[V]) SetWithNotExist(key string, value V) (V, bool) {
-	index := m.getIndex(key)
-	m.datas[index].Lock()
-	defer m.datas[index].Unlock()
-	if val, ok := m.datas[index].data[key]; ok {
-		return val, false
+func (m *Map[K, V]) SetWithNotExist(key K, value V) (V, bool) {
+	for {
+		table := m.table.Load()
+		index := m.getIndex(table, key)
+		v, created, retired := table.datas[index].setIfAbsent(key, value)
+		if !retired {
+			return v, created
+		}
 	}
-	m.datas[index].data[key] = value
-	return value, true
 }
 
-func (m *Map[V]) Get(key string) (V, bool) {
-	index := m.getIndex(key)
-	m.datas[index].RLock()
-	defer m.datas[index].RUnlock()
-	value, ok := m.datas[index].data[key]
-	return value, ok
+// Get 优先无锁读取分片的只读快照，只有在快照未命中且存在分叉时才会短暂
+// 加锁访问 dirty；如果命中的分片恰好已被 Rebalance 迁移走，会对最新的分
+// 片拓扑重试
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	for {
+		table := m.table.Load()
+		index := m.getIndex(table, key)
+		v, ok, retired := table.datas[index].load(key)
+		if !retired {
+			return v, ok
+		}
+	}
 }
 
-func (m *Map[V]) GetWithDefault(key string, defaultValue V) (V, bool) {
-	index := m.getIndex(key)
-	m.datas[index].RLock()
-	defer m.datas[index].RUnlock()
-	value, ok := m.datas[index].data[key]
+func (m *Map[K, V]) GetWithDefault(key K, defaultValue V) (V, bool) {
+	value, ok := m.Get(key)
 	if !ok {
 		value = defaultValue
 	}
 	return value, ok
 }
 
-func (m *Map[V]) Delete(key string) bool {
-	index := m.getIndex(key)
+// Delete 对 read 快照中的 key 无锁地标记为已删除（墓碑），快照无需因此立即
+// 重建；key 只在 dirty 中时在分片锁内删除。目标分片被并发 Rebalance 迁移走
+// 时会对最新的分片拓扑重试。
+func (m *Map[K, V]) Delete(key K) bool {
+	for {
+		table := m.table.Load()
+		index := m.getIndex(table, key)
+		_, ok, retired := table.datas[index].delete(key)
+		if !retired {
+			return ok
+		}
+	}
+}
 
-	m.datas[index].Lock()
-	defer m.datas[index].Unlock()
-	_, ok := m.datas[index].data[key]
-	if !ok {
-		return false
+// 为保证数据一致性，CAS 失败时会用最新值重新执行 delIf；key 位于 read 快照
+// 时不会对分片加锁，key 只在 dirty 中或撞见 expunged 时在锁内执行 delIf。
+// 在delIf函数中进行读取，修改等操作，可能导致key落在同一片分片导致死锁。
+// 目标分片被并发 Rebalance 迁移走时会对最新的分片拓扑重试。
+func (m *Map[K, V]) DeleteIf(key K, delIf func(V) bool) bool {
+	for {
+		table := m.table.Load()
+		index := m.getIndex(table, key)
+		ok, retired := table.datas[index].deleteIf(key, delIf)
+		if !retired {
+			return ok
+		}
 	}
-	delete(m.datas[index].data, key)
-	return true
 }
 
-// 为保证数据一致性，锁内执行delIf函数
-// 在delIf函数中进行读取，修改等操作，可能导致key落在同一片分片导致死锁
-func (m *Map[V]) DeleteIf(key string, delIf func(V) bool) bool {
-	index := m.getIndex(key)
+// Compute 持有分片写锁完成一次读取-计算-写入/删除，避免 Get 与 Set 之间的
+// 竞态。fn 在锁内执行，返回值为新值与是否删除；返回结果是操作后的值与 key
+// 是否仍然存在。
+// 与 DeleteIf/Prune 一样：不要在 fn 中访问同一个 Map，否则可能因为 key
+// 落在同一分片导致死锁。目标分片被并发 Rebalance 迁移走时会对最新的分片
+// 拓扑重试。
+func (m *Map[K, V]) Compute(key K, fn func(old V, exists bool) (newValue V, remove bool)) (V, bool) {
+	for {
+		table := m.table.Load()
+		index := m.getIndex(table, key)
+		mi := table.datas[index]
+		mi.Lock()
+		if mi.retired.Load() {
+			mi.Unlock()
+			continue
+		}
 
-	m.datas[index].Lock()
-	defer m.datas[index].Unlock()
-	val, ok := m.datas[index].data[key]
-	if !ok {
-		return false
+		old, exists := mi.getLocked(key)
+		newValue, remove := fn(old, exists)
+		if remove {
+			if exists {
+				mi.deleteLocked(key)
+			}
+			mi.Unlock()
+			var zero V
+			return zero, false
+		}
+		mi.setLocked(key, newValue)
+		mi.Unlock()
+		return newValue, true
 	}
-	if !delIf(val) {
-		return false
+}
+
+// UpsertIf 持有分片写锁完成一次读取-计算-按需写入，fn 返回 apply=false 时
+// 保持原值不变；适合 LoadOrStore-with-computed-default 场景：fn 在
+// exists=false 时计算默认值并返回 true 即可完成写入。
+// 与 Compute 一样：不要在 fn 中访问同一个 Map。目标分片被并发 Rebalance
+// 迁移走时会对最新的分片拓扑重试。
+func (m *Map[K, V]) UpsertIf(key K, fn func(old V, exists bool) (V, bool)) (V, bool) {
+	for {
+		table := m.table.Load()
+		index := m.getIndex(table, key)
+		mi := table.datas[index]
+		mi.Lock()
+		if mi.retired.Load() {
+			mi.Unlock()
+			continue
+		}
+
+		old, exists := mi.getLocked(key)
+		newValue, apply := fn(old, exists)
+		if !apply {
+			mi.Unlock()
+			return old, exists
+		}
+		mi.setLocked(key, newValue)
+		mi.Unlock()
+		return newValue, true
 	}
-	delete(m.datas[index].data, key)
-	return true
 }
 
-func (m *Map[V]) Len() int {
+func (m *Map[K, V]) Len() int {
+	table := m.table.Load()
 	var count int
-	for i := range m.datas {
+	for i := range table.datas {
 		func() {
-			m.datas[i].RLock()
-			defer m.datas[i].RUnlock()
-			count += len(m.datas[i].data)
+			table.datas[i].RLock()
+			defer table.datas[i].RUnlock()
+			for _, e := range table.datas[i].effective() {
+				if _, ok := e.load(table.datas[i].expunged); ok {
+					count++
+				}
+			}
 		}()
 	}
 	return count
 }
 
 // 主要是用于内部调试，观察分片数据是否倾斜
-func (m *Map[V]) LenWithSlice() []int {
-	counts := make([]int, 0, len(m.datas))
-	for i := range m.datas {
+func (m *Map[K, V]) LenWithSlice() []int {
+	table := m.table.Load()
+	counts := make([]int, 0, len(table.datas))
+	for i := range table.datas {
 		func() {
-			m.datas[i].RLock()
-			defer m.datas[i].RUnlock()
-			counts = append(counts, len(m.datas[i].data))
+			table.datas[i].RLock()
+			defer table.datas[i].RUnlock()
+			count := 0
+			for _, e := range table.datas[i].effective() {
+				if _, ok := e.load(table.datas[i].expunged); ok {
+					count++
+				}
+			}
+			counts = append(counts, count)
 		}()
 	}
 	return counts
 }
 
-func (m *Map[V]) Clear() {
-	for i := range m.datas {
+func (m *Map[K, V]) Clear() {
+	table := m.table.Load()
+	for i := range table.datas {
 		func() {
-			m.datas[i].Lock()
-			defer m.datas[i].Unlock()
-			m.datas[i].data = make(map[string]V)
+			table.datas[i].Lock()
+			defer table.datas[i].Unlock()
+			table.datas[i].read.Store(&readOnly[K, V]{m: make(map[K]*entry[V])})
+			table.datas[i].dirty = nil
+			table.datas[i].missCount = 0
 		}()
 	}
 }
 
-func (m *Map[V]) Range(f func(key string, value V) bool) {
-	for i := range m.datas {
-		m.datas[i].RLock()
-		tmpMaps := make(map[string]V, len(m.datas[i].data))
-		maps.Copy(tmpMaps, m.datas[i].data)
-		m.datas[i].RUnlock()
+func (m *Map[K, V]) Range(f func(key K, value V) bool) {
+	table := m.table.Load()
+	for i := range table.datas {
+		mi := table.datas[i]
+		mi.RLock()
+		eff := mi.effective()
+		tmpMaps := make(map[K]V, len(eff))
+		for k, e := range eff {
+			if v, ok := e.load(mi.expunged); ok {
+				tmpMaps[k] = v
+			}
+		}
+		mi.RUnlock()
 		for key, value := range tmpMaps {
 			if !f(key, value) {
 				return
@@ -181,28 +767,118 @@ func (m *Map[V]) Range(f func(key string, value V) bool) {
 	}
 }
 
-// Prune方法会在持有锁的情况下进行分片遍历
+// RangeShard 直接在分片的读锁内遍历，不做整分片拷贝，适合单个分片数据量很
+// 大、Range 的拷贝开销和写入者等待时间都不可接受的场景。
+// 如果在 f 函数中进行读取，修改等操作，可能导致key落在同一片分片导致死锁，
+// 这一点和 Prune 一致。f 返回 false 会停止后续所有分片的遍历。
+func (m *Map[K, V]) RangeShard(f func(key K, value V) bool) {
+	table := m.table.Load()
+	for i := range table.datas {
+		mi := table.datas[i]
+		stop := false
+		func() {
+			mi.RLock()
+			defer mi.RUnlock()
+			for key, e := range mi.effective() {
+				value, ok := e.load(mi.expunged)
+				if !ok {
+					continue
+				}
+				if !f(key, value) {
+					stop = true
+					return
+				}
+			}
+		}()
+		if stop {
+			return
+		}
+	}
+}
+
+// RangeShardParallel 与 RangeShard 语义相同，但把分片分发给 nWorkers 个
+// goroutine 并发处理，适合分片数较多、遍历本身比较耗时的全量扫描。
+// f 会被多个 goroutine 并发调用，调用方需要自行保证 f 的并发安全；f 返回
+// false 只会让调用它的 worker 提前结束当前分片，不会中止其它分片或 worker。
+// nWorkers < 1 时按 1 处理。
+func (m *Map[K, V]) RangeShardParallel(nWorkers int, f func(key K, value V) bool) {
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+
+	table := m.table.Load()
+	shardIdx := make(chan int, len(table.datas))
+	for i := range table.datas {
+		shardIdx <- i
+	}
+	close(shardIdx)
+
+	var wg sync.WaitGroup
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range shardIdx {
+				mi := table.datas[i]
+				func() {
+					mi.RLock()
+					defer mi.RUnlock()
+					for key, e := range mi.effective() {
+						value, ok := e.load(mi.expunged)
+						if !ok {
+							continue
+						}
+						if !f(key, value) {
+							return
+						}
+					}
+				}()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Snapshot 返回所有分片当前数据的一份合并拷贝，适合确实需要一次性拿到完整
+// 视图的调用方；底层复用 Range 按分片加读锁、逐个拷贝。
+func (m *Map[K, V]) Snapshot() map[K]V {
+	result := make(map[K]V, m.Len())
+	m.Range(func(key K, value V) bool {
+		result[key] = value
+		return true
+	})
+	return result
+}
+
+// Prune方法会在持有分片读锁的情况下进行遍历，命中删除条件的 entry 直接无锁
+// 打墓碑标记，不需要重建快照
 // 如果在 f 函数中进行读取，修改等操作，可能导致key落在同一片分片导致死锁
 // f 函数返回值：
 //
 //	true ：删除该数据
 //	false：保留该数据
 //	error：停止清洗操作，返回错误
-func (m *Map[V]) Prune(f func(key string, value V) (bool, error)) (int, int, error) {
+func (m *Map[K, V]) Prune(f func(key K, value V) (bool, error)) (int, int, error) {
+	table := m.table.Load()
 	delNum := 0
 	nowNum := 0
-	for i := range m.datas {
+	for i := range table.datas {
+		mi := table.datas[i]
 		err := func() error {
-			m.datas[i].Lock()
-			defer m.datas[i].Unlock()
-			for key, value := range m.datas[i].data {
-				ok, err := f(key, value)
+			mi.RLock()
+			defer mi.RUnlock()
+			for key, e := range mi.effective() {
+				value, ok := e.load(mi.expunged)
+				if !ok {
+					continue
+				}
+				del, err := f(key, value)
 				if err != nil {
 					return err
 				}
-				if ok {
+				if del {
 					delNum++
-					delete(m.datas[i].data, key)
+					e.tombstone(mi.expunged)
 				} else {
 					nowNum++
 				}
@@ -216,6 +892,176 @@ func (m *Map[V]) Prune(f func(key string, value V) (bool, error)) (int, int, err
 	return delNum, nowNum, nil
 }
 
-func (m *Map[V]) ShardCount() int {
-	return len(m.datas)
+func (m *Map[K, V]) ShardCount() int {
+	return len(m.table.Load().datas)
+}
+
+// rebalanceTo 把 Map 重建为 newShardCount 个分片（向上取整到 2 的幂次）并
+// 换用新生成的 maphash.Seed。迁移对每个旧分片加锁，用 freezeLocked 把待搬
+// 迁的 entry 原子标记为 expunged 后再拷贝到新分片（单纯持锁搬运挡不住
+// entry 的无锁写路径，见 entry 的注释），标记完成后置位 retired；所有旧
+// 分片的锁直到新拓扑发布之后才会释放。调用方必须持有 rebalanceMu。
+func (m *Map[K, V]) rebalanceTo(newShardCount int) {
+	newShardCount = trueShards(newShardCount)
+	oldTable := m.table.Load()
+	if newShardCount == len(oldTable.datas) {
+		return
+	}
+
+	newSeed := maphash.MakeSeed()
+	newDatas := make([]*mapItem[K, V], newShardCount)
+	for i := range newDatas {
+		newDatas[i] = newMapItem[K, V]()
+	}
+	newTable := &shardTable[K, V]{datas: newDatas, seed: newSeed}
+
+	for _, mi := range oldTable.datas {
+		mi.Lock()
+		defer mi.Unlock()
+		mi.dirtyLocked()
+		for key, e := range mi.dirty {
+			value, ok := e.freezeLocked(mi.expunged)
+			if !ok {
+				continue
+			}
+			hash := m.hasher.Hash(newSeed, key)
+			idx := int(hash & uint64(newShardCount-1))
+			newDatas[idx].store(key, value)
+		}
+		mi.retired.Store(true)
+	}
+
+	m.table.Store(newTable)
+}
+
+// Rebalance 手动把 Map 重建为 newShardCount 个分片（会向上取整到 2 的幂
+// 次），适合在观测到 LenWithSlice 明显倾斜、又不想等待 AutoRebalance 定期
+// 采样时主动触发。多个并发调用会被串行化执行。
+func (m *Map[K, V]) Rebalance(newShardCount int) {
+	m.rebalanceMu.Lock()
+	defer m.rebalanceMu.Unlock()
+	m.rebalanceTo(newShardCount)
+}
+
+const (
+	defaultRebalanceInterval = time.Minute
+	defaultSkewThreshold     = 4.0
+)
+
+// autoRebalanceOptions 收集 AutoRebalance 的功能性选项
+type autoRebalanceOptions struct {
+	interval      time.Duration
+	skewThreshold float64
+	maxShardCount int
+}
+
+// AutoRebalanceOption 是传给 AutoRebalance 的功能性选项
+type AutoRebalanceOption func(*autoRebalanceOptions)
+
+// WithAutoRebalanceInterval 覆盖采样/触发重建的检查间隔，默认 1 分钟
+func WithAutoRebalanceInterval(interval time.Duration) AutoRebalanceOption {
+	return func(o *autoRebalanceOptions) {
+		o.interval = interval
+	}
+}
+
+// WithSkewThreshold 覆盖触发重建所需的最大/最小分片大小比值，默认 4。
+// 空分片不计入最小值的统计，避免 key 数量还很少时就被误判为严重倾斜。
+func WithSkewThreshold(threshold float64) AutoRebalanceOption {
+	return func(o *autoRebalanceOptions) {
+		o.skewThreshold = threshold
+	}
+}
+
+// WithMaxShardCount 限制自动扩容能达到的最大分片数，默认不限制（由
+// trueShards 的上限 1<<16 兜底）
+func WithMaxShardCount(maxShardCount int) AutoRebalanceOption {
+	return func(o *autoRebalanceOptions) {
+		o.maxShardCount = maxShardCount
+	}
+}
+
+// Rebalancer 是 AutoRebalance 启动的后台采样 goroutine 的句柄，用完后必须
+// 调用 Close 停止该 goroutine，用法与 TTLMap 的 Close 一致。
+type Rebalancer struct {
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Close 停止后台采样 goroutine，可安全多次调用
+func (r *Rebalancer) Close() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
+	r.wg.Wait()
+}
+
+// AutoRebalance 启动一个后台 goroutine，按 interval 定期采样各分片大小，
+// 当 max/min 比值超过 skewThreshold 时把分片数翻倍（不超过 maxShardCount）
+// 并触发一次 Rebalance，用于应对固定分片数无法自愈的热点 key 倾斜问题。
+// 返回的 Rebalancer 用完后需要 Close。
+func (m *Map[K, V]) AutoRebalance(opts ...AutoRebalanceOption) *Rebalancer {
+	o := autoRebalanceOptions{
+		interval:      defaultRebalanceInterval,
+		skewThreshold: defaultSkewThreshold,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	r := &Rebalancer{stopCh: make(chan struct{})}
+	r.wg.Add(1)
+	go m.autoRebalanceLoop(r, o)
+	return r
+}
+
+func (m *Map[K, V]) autoRebalanceLoop(r *Rebalancer, o autoRebalanceOptions) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			m.maybeRebalance(o)
+		}
+	}
+}
+
+// maybeRebalance 采样当前分片大小分布，倾斜超过阈值时把分片数翻倍并触发
+// 重建；未超过阈值或已达到 maxShardCount 时不做任何事。
+func (m *Map[K, V]) maybeRebalance(o autoRebalanceOptions) {
+	counts := m.LenWithSlice()
+	maxCount, minCount := 0, -1
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if c > maxCount {
+			maxCount = c
+		}
+		if minCount == -1 || c < minCount {
+			minCount = c
+		}
+	}
+	if minCount <= 0 {
+		return
+	}
+	if float64(maxCount)/float64(minCount) <= o.skewThreshold {
+		return
+	}
+
+	newShardCount := len(counts) * 2
+	for o.maxShardCount > 0 && newShardCount > o.maxShardCount {
+		newShardCount /= 2
+	}
+	if newShardCount <= len(counts) {
+		return
+	}
+
+	m.rebalanceMu.Lock()
+	defer m.rebalanceMu.Unlock()
+	m.rebalanceTo(newShardCount)
 }
@@ -0,0 +1,212 @@
+package hmap
+
+import (
+	"fmt"
+	"hash/maphash"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// rwMutexShardedMap 重现 chunk0-1 之前纯分片 RWMutex 的实现（Get 走
+// RLock，Set 走 Lock，没有无锁 read 快照），仅用于跟当前的 read/dirty 方案
+// 做吞吐对比，不作为生产代码维护。
+type rwMutexShardedMap[V any] struct {
+	datas []*rwMutexShard[V]
+	seed  maphash.Seed
+}
+
+type rwMutexShard[V any] struct {
+	sync.RWMutex
+	data map[string]V
+}
+
+func newRWMutexShardedMap[V any](shardCount int) *rwMutexShardedMap[V] {
+	m := &rwMutexShardedMap[V]{seed: maphash.MakeSeed(), datas: make([]*rwMutexShard[V], shardCount)}
+	for i := range m.datas {
+		m.datas[i] = &rwMutexShard[V]{data: make(map[string]V)}
+	}
+	return m
+}
+
+func (m *rwMutexShardedMap[V]) getIndex(key string) int {
+	hash := maphash.String(m.seed, key)
+	return int(hash & uint64(len(m.datas)-1))
+}
+
+func (m *rwMutexShardedMap[V]) Set(key string, value V) {
+	idx := m.getIndex(key)
+	m.datas[idx].Lock()
+	defer m.datas[idx].Unlock()
+	m.datas[idx].data[key] = value
+}
+
+func (m *rwMutexShardedMap[V]) Get(key string) (V, bool) {
+	idx := m.getIndex(key)
+	m.datas[idx].RLock()
+	defer m.datas[idx].RUnlock()
+	v, ok := m.datas[idx].data[key]
+	return v, ok
+}
+
+// BenchmarkMap_Get_ReadHeavy_RWMutexBaseline 是 BenchmarkMap_Get_ReadHeavy
+// 对应的旧实现基线：同样的 key 集合和并发度，但 Get 全程走分片 RLock，没有
+// 无锁 read 快照。两者的 ns/op 差值就是 chunk0-1 这次改动的实际收益。
+func BenchmarkMap_Get_ReadHeavy_RWMutexBaseline(b *testing.B) {
+	const keyCount = 10000
+	m := newRWMutexShardedMap[int](defaultShardCount)
+	keys := make([]string, keyCount)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		m.Set(keys[i], i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			m.Get(keys[i%keyCount])
+			i++
+		}
+	})
+}
+
+// BenchmarkMap_Get_MixedReadWrite_RWMutexBaseline 是
+// BenchmarkMap_Get_MixedReadWrite 对应的旧实现基线
+func BenchmarkMap_Get_MixedReadWrite_RWMutexBaseline(b *testing.B) {
+	const keyCount = 10000
+	m := newRWMutexShardedMap[int](defaultShardCount)
+	keys := make([]string, keyCount)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		m.Set(keys[i], i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := keys[i%keyCount]
+			if i%100 == 0 {
+				m.Set(k, i)
+			} else {
+				m.Get(k)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkMap_Set_RWMutexBaseline 是 BenchmarkMap_Set 对应的旧实现基线
+func BenchmarkMap_Set_RWMutexBaseline(b *testing.B) {
+	m := newRWMutexShardedMap[int](defaultShardCount)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			m.Set(fmt.Sprintf("k%d", i), i)
+			i++
+		}
+	})
+}
+
+// 读多写少、key 集合稳定的场景下，Get 应该能命中无锁的 read 快照，
+// 吞吐随 GOMAXPROCS 近似线性扩展，而不是被分片 RWMutex 的 RLock 争用卡住。
+func BenchmarkMap_Get_ReadHeavy(b *testing.B) {
+	const keyCount = 10000
+	m := New[string, int]()
+	keys := make([]string, keyCount)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		m.Set(keys[i], i)
+	}
+	// 预热：先触发一轮 Get 把 key 集合提升进 read 快照，排除首次分叉的影响
+	for _, k := range keys {
+		m.Get(k)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			m.Get(keys[i%keyCount])
+			i++
+		}
+	})
+}
+
+// 在稳定读的基础上混入少量写入，模拟 key 集合基本稳定但偶有更新的缓存场景
+func BenchmarkMap_Get_MixedReadWrite(b *testing.B) {
+	const keyCount = 10000
+	m := New[string, int]()
+	keys := make([]string, keyCount)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		m.Set(keys[i], i)
+	}
+	for _, k := range keys {
+		m.Get(k)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := keys[i%keyCount]
+			if i%100 == 0 {
+				m.Set(k, i)
+			} else {
+				m.Get(k)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMap_Set(b *testing.B) {
+	m := New[string, int]()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			m.Set(fmt.Sprintf("k%d", i), i)
+			i++
+		}
+	})
+}
+
+func newFullMap(keyCount int) *Map[string, int] {
+	m := New[string, int]()
+	for i := 0; i < keyCount; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	return m
+}
+
+// Range 在遍历前会把每个分片整体拷贝一份，key 集合很大时这份拷贝本身就是
+// 主要开销
+func BenchmarkMap_Range(b *testing.B) {
+	m := newFullMap(200000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Range(func(key string, value int) bool { return true })
+	}
+}
+
+// RangeShard 直接在分片读锁内遍历，省掉了 Range 的整分片拷贝
+func BenchmarkMap_RangeShard(b *testing.B) {
+	m := newFullMap(200000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.RangeShard(func(key string, value int) bool { return true })
+	}
+}
+
+// RangeShardParallel 把分片分发给多个 goroutine，全量扫描可以利用多核
+func BenchmarkMap_RangeShardParallel(b *testing.B) {
+	m := newFullMap(200000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.RangeShardParallel(8, func(key string, value int) bool { return true })
+	}
+}
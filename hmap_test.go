@@ -0,0 +1,460 @@
+package hmap
+
+import (
+	"hash/maphash"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMapItem_MissPromotesDirtyToRead drives enough read misses against a
+// shard with a fork (dirty != read) to trigger missLocked's promotion, and
+// checks that dirty gets folded into a fresh read snapshot and the miss
+// counter resets.
+func TestMapItem_MissPromotesDirtyToRead(t *testing.T) {
+	mi := newMapItem[string, int]()
+	const keys = 3
+	for i := 0; i < keys; i++ {
+		mi.store(strconv.Itoa(i), i)
+	}
+	if mi.dirty == nil || len(mi.dirty) != keys {
+		t.Fatalf("expected %d keys forked into dirty, got %v", keys, mi.dirty)
+	}
+	if !mi.read.Load().amended {
+		t.Fatalf("expected the fork to have marked the read snapshot amended")
+	}
+
+	for i := 0; i < keys; i++ {
+		if _, ok, _ := mi.load("missing"); ok {
+			t.Fatalf("expected \"missing\" to not be found")
+		}
+	}
+
+	if mi.dirty != nil {
+		t.Fatalf("expected dirty to be folded into read after %d misses, got %v", keys, mi.dirty)
+	}
+	if mi.missCount != 0 {
+		t.Fatalf("expected missCount to reset after promotion, got %d", mi.missCount)
+	}
+	read := mi.read.Load()
+	if len(read.m) != keys {
+		t.Fatalf("expected promoted read snapshot to carry %d keys, got %d", keys, len(read.m))
+	}
+	for i := 0; i < keys; i++ {
+		v, ok, retired := mi.load(strconv.Itoa(i))
+		if !ok || v != i || retired {
+			t.Fatalf("key %d: got %v %v %v, want %v true false", i, v, ok, retired, i)
+		}
+	}
+}
+
+// TestEntry_TombstoneExpungeResurrect walks a single entry through its full
+// lifecycle: delete tombstones it in place, rebuilding dirty from a read
+// snapshot that still holds the tombstone expunges it and drops it from the
+// new dirty, and a later Set on the same key resurrects the same entry via
+// unexpungeLocked rather than allocating a new one.
+func TestEntry_TombstoneExpungeResurrect(t *testing.T) {
+	mi := newMapItem[string, int]()
+	mi.store("a", 1)
+
+	// one miss is enough to promote, since dirty only holds "a"
+	if _, ok, _ := mi.load("missing"); ok {
+		t.Fatal("expected \"missing\" to not be found")
+	}
+	read := mi.read.Load()
+	e, ok := read.m["a"]
+	if !ok {
+		t.Fatal("expected \"a\" to have been promoted into the read snapshot")
+	}
+
+	if v, ok, _ := mi.delete("a"); !ok || v != 1 {
+		t.Fatalf("delete: got %v %v, want 1 true", v, ok)
+	}
+	if _, ok, _ := mi.load("a"); ok {
+		t.Fatal("expected \"a\" to be gone right after delete")
+	}
+
+	// forking dirty off the read snapshot should expunge the tombstone
+	// and drop it from the new dirty instead of carrying it forward
+	mi.store("b", 2)
+	if !e.isExpunged(mi.expunged) {
+		t.Fatal("expected the tombstoned entry to be expunged once dirty was rebuilt")
+	}
+	if _, inDirty := mi.dirty["a"]; inDirty {
+		t.Fatal("expected the expunged tombstone to be dropped from the rebuilt dirty")
+	}
+
+	mi.store("a", 99)
+	if got, ok := read.m["a"]; !ok || got != e {
+		t.Fatal("expected resurrecting \"a\" to reuse the same entry via unexpungeLocked")
+	}
+	if v, ok, _ := mi.load("a"); !ok || v != 99 {
+		t.Fatalf("load after resurrect: got %v %v, want 99 true", v, ok)
+	}
+}
+
+// TestMap_ConcurrentGetSetDeleteOnSharedKeys hammers Get/Set/Delete from
+// many goroutines against a handful of shared keys. It doesn't assert
+// linearizable results (Delete racing Set on the same key has no single
+// right answer), only that every observed value was one this test actually
+// wrote and that nothing panics or deadlocks; `go test -race` covers the
+// rest.
+func TestMap_ConcurrentGetSetDeleteOnSharedKeys(t *testing.T) {
+	m := New[string, int](WithShardCount[string, int](2))
+	const keys = 4
+	const iterations = 20000
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				k := strconv.Itoa(i % keys)
+				switch i % 3 {
+				case 0:
+					m.Set(k, worker)
+				case 1:
+					if v, ok := m.Get(k); ok && (v < 0 || v >= 8) {
+						t.Errorf("got out-of-range value %d for key %s", v, k)
+					}
+				case 2:
+					m.Delete(k)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestNew_DefaultHasherForStringAndInt(t *testing.T) {
+	sm := New[string, int]()
+	sm.Set("a", 1)
+	if v, ok := sm.Get("a"); !ok || v != 1 {
+		t.Fatalf("string key: got %v %v, want 1 true", v, ok)
+	}
+
+	im := New[int64, string]()
+	im.Set(42, "answer")
+	if v, ok := im.Get(42); !ok || v != "answer" {
+		t.Fatalf("int64 key: got %v %v, want answer true", v, ok)
+	}
+}
+
+func TestBytesHasher_RoundTrip(t *testing.T) {
+	m := New[[16]byte, int](WithHasher[[16]byte, int](BytesHasher[[16]byte]{}))
+
+	var a, b [16]byte
+	a[0] = 1
+	b[0] = 2
+	m.Set(a, 1)
+	m.Set(b, 2)
+
+	if v, ok := m.Get(a); !ok || v != 1 {
+		t.Fatalf("key a: got %v %v, want 1 true", v, ok)
+	}
+	if v, ok := m.Get(b); !ok || v != 2 {
+		t.Fatalf("key b: got %v %v, want 2 true", v, ok)
+	}
+}
+
+func TestNew_PanicsWithoutHasherForArrayKey(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected New to panic for a key type with no default Hasher")
+		}
+	}()
+	New[[16]byte, int]()
+}
+
+func TestCompute_CreateUpdateRemove(t *testing.T) {
+	m := New[string, int]()
+
+	v, ok := m.Compute("a", func(old int, exists bool) (int, bool) {
+		if exists {
+			t.Fatalf("expected a to not exist yet")
+		}
+		return 1, false
+	})
+	if !ok || v != 1 {
+		t.Fatalf("create: got %v %v, want 1 true", v, ok)
+	}
+
+	v, ok = m.Compute("a", func(old int, exists bool) (int, bool) {
+		if !exists || old != 1 {
+			t.Fatalf("update: got old=%v exists=%v, want 1 true", old, exists)
+		}
+		return old + 1, false
+	})
+	if !ok || v != 2 {
+		t.Fatalf("update: got %v %v, want 2 true", v, ok)
+	}
+
+	v, ok = m.Compute("a", func(old int, exists bool) (int, bool) {
+		if !exists || old != 2 {
+			t.Fatalf("remove: got old=%v exists=%v, want 2 true", old, exists)
+		}
+		return 0, true
+	})
+	if ok {
+		t.Fatalf("remove: got %v %v, want _ false", v, ok)
+	}
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("a should have been removed by Compute")
+	}
+}
+
+func TestUpsertIf_ApplyAndDecline(t *testing.T) {
+	m := New[string, int]()
+
+	v, ok := m.UpsertIf("a", func(old int, exists bool) (int, bool) {
+		if exists {
+			t.Fatalf("expected a to not exist yet")
+		}
+		return 10, true
+	})
+	if !ok || v != 10 {
+		t.Fatalf("apply on create: got %v %v, want 10 true", v, ok)
+	}
+
+	v, ok = m.UpsertIf("a", func(old int, exists bool) (int, bool) {
+		return old, false
+	})
+	if !ok || v != 10 {
+		t.Fatalf("decline: got %v %v, want 10 true (unchanged)", v, ok)
+	}
+	if got, _ := m.Get("a"); got != 10 {
+		t.Fatalf("decline should not have modified value, got %v", got)
+	}
+}
+
+func newFilledMap(keyCount int) *Map[string, int] {
+	m := New[string, int]()
+	for i := 0; i < keyCount; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	return m
+}
+
+func TestRangeShard_VisitsEveryKey(t *testing.T) {
+	const keyCount = 5000
+	m := newFilledMap(keyCount)
+
+	seen := make(map[string]int, keyCount)
+	var mu sync.Mutex
+	m.RangeShard(func(key string, value int) bool {
+		mu.Lock()
+		seen[key] = value
+		mu.Unlock()
+		return true
+	})
+
+	if len(seen) != keyCount {
+		t.Fatalf("expected %d keys, got %d", keyCount, len(seen))
+	}
+	for i := 0; i < keyCount; i++ {
+		k := strconv.Itoa(i)
+		if v, ok := seen[k]; !ok || v != i {
+			t.Fatalf("key %s: got %v %v, want %v true", k, v, ok, i)
+		}
+	}
+}
+
+func TestRangeShard_StopsEarly(t *testing.T) {
+	m := newFilledMap(1000)
+	var visited int32
+	m.RangeShard(func(key string, value int) bool {
+		atomic.AddInt32(&visited, 1)
+		return false
+	})
+	if visited != 1 {
+		t.Fatalf("expected RangeShard to stop after the first key, visited %d", visited)
+	}
+}
+
+func TestRangeShardParallel_VisitsEveryKey(t *testing.T) {
+	const keyCount = 5000
+	m := newFilledMap(keyCount)
+
+	var mu sync.Mutex
+	seen := make(map[string]int, keyCount)
+	m.RangeShardParallel(8, func(key string, value int) bool {
+		mu.Lock()
+		seen[key] = value
+		mu.Unlock()
+		return true
+	})
+
+	if len(seen) != keyCount {
+		t.Fatalf("expected %d keys, got %d", keyCount, len(seen))
+	}
+}
+
+func TestSnapshot_MatchesLiveData(t *testing.T) {
+	const keyCount = 2000
+	m := newFilledMap(keyCount)
+
+	snap := m.Snapshot()
+	if len(snap) != keyCount {
+		t.Fatalf("expected snapshot of %d keys, got %d", keyCount, len(snap))
+	}
+	for i := 0; i < keyCount; i++ {
+		k := strconv.Itoa(i)
+		if v, ok := snap[k]; !ok || v != i {
+			t.Fatalf("key %s: got %v %v, want %v true", k, v, ok, i)
+		}
+	}
+
+	// 修改 Map 不应该影响已经返回的快照
+	m.Set("0", -1)
+	if snap["0"] != 0 {
+		t.Fatal("Snapshot should be a copy, not a live view")
+	}
+}
+
+func TestRebalance_PreservesExistingData(t *testing.T) {
+	m := New[string, int](WithShardCount[string, int](2))
+	for i := 0; i < 500; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	m.Rebalance(32)
+
+	if got := m.ShardCount(); got != 32 {
+		t.Fatalf("expected shard count 32, got %d", got)
+	}
+	for i := 0; i < 500; i++ {
+		v, ok := m.Get(strconv.Itoa(i))
+		if !ok || v != i {
+			t.Fatalf("key %d: got %v %v, want %v true", i, v, ok, i)
+		}
+	}
+	if got := m.Len(); got != 500 {
+		t.Fatalf("expected len 500, got %d", got)
+	}
+}
+
+// TestRebalance_ConcurrentWritesNotLost pins down the race a reviewer found
+// in the first cut of Rebalance: a lock-free Set racing the migration's
+// per-entry copy must never be silently dropped just because it landed on
+// a shard that gets retired mid-flight. Each worker owns a disjoint key
+// range, so any Get right after a Set for that key must reflect exactly
+// what was just written.
+func TestRebalance_ConcurrentWritesNotLost(t *testing.T) {
+	m := New[string, int](WithShardCount[string, int](4))
+	const perWorkerKeys = 64
+	const iterations = 4000
+
+	var wg sync.WaitGroup
+	var stop int32
+	var misses int32
+
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < iterations && atomic.LoadInt32(&stop) == 0; i++ {
+				k := "w" + strconv.Itoa(worker) + "-" + strconv.Itoa(i%perWorkerKeys)
+				m.Set(k, i)
+				if got, ok := m.Get(k); !ok || got != i {
+					atomic.AddInt32(&misses, 1)
+				}
+			}
+		}(w)
+	}
+
+	for i := 0; i < 20; i++ {
+		m.Rebalance(4 << uint(i%5))
+		time.Sleep(time.Millisecond)
+	}
+
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if misses != 0 {
+		t.Fatalf("observed %d read-after-write mismatches across concurrent Rebalance calls", misses)
+	}
+}
+
+// TestRebalance_SequentialSetGetNeverLosesWrite reproduces the exact
+// sequential Set-then-Get pattern that surfaced the lock-free migration
+// race: without freezing entries during migration, a concurrent Rebalance
+// could silently drop a Set whose value had already been copied to the new
+// table before the write landed on the old, soon-to-be-discarded shard.
+func TestRebalance_SequentialSetGetNeverLosesWrite(t *testing.T) {
+	m := New[string, int](WithShardCount[string, int](2))
+	const key = "hot"
+
+	var wg sync.WaitGroup
+	var stop int32
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shardCounts := []int{2, 4, 8, 4, 2}
+		for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+			m.Rebalance(shardCounts[i%len(shardCounts)])
+		}
+	}()
+
+	for i := 0; i < 200000; i++ {
+		m.Set(key, i)
+		if got, ok := m.Get(key); !ok || got != i {
+			atomic.StoreInt32(&stop, 1)
+			wg.Wait()
+			t.Fatalf("iteration %d: Get after Set returned %v %v, want %v true", i, got, ok, i)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
+
+// skewedHasher sends most keys to hash bucket 0 and a small minority to
+// bucket 1, deterministically producing a lopsided shard distribution
+// regardless of maphash.Seed, for TestAutoRebalance_TriggersOnSkew.
+type skewedHasher struct{}
+
+func (skewedHasher) Hash(_ maphash.Seed, key int) uint64 {
+	if key%10 == 0 {
+		return 1
+	}
+	return 0
+}
+
+func TestAutoRebalance_TriggersOnSkew(t *testing.T) {
+	m := New[int, int](WithShardCount[int, int](2), WithHasher[int, int](skewedHasher{}))
+	for i := 0; i < 200; i++ {
+		m.Set(i, i)
+	}
+
+	r := m.AutoRebalance(
+		WithAutoRebalanceInterval(5*time.Millisecond),
+		WithSkewThreshold(1.5),
+		WithMaxShardCount(64),
+	)
+	defer r.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if m.ShardCount() > 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.ShardCount() <= 2 {
+		t.Fatalf("expected AutoRebalance to have grown shard count, still %d", m.ShardCount())
+	}
+	for i := 0; i < 200; i++ {
+		if _, ok := m.Get(i); !ok {
+			t.Fatalf("key %d missing after auto rebalance", i)
+		}
+	}
+}
+
+func TestRebalancer_CloseIsIdempotent(t *testing.T) {
+	m := New[int, int]()
+	r := m.AutoRebalance(WithAutoRebalanceInterval(5 * time.Millisecond))
+	r.Close()
+	r.Close()
+}
@@ -0,0 +1,134 @@
+package hmap
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultSweepInterval = time.Minute
+
+// ttlEntry 包裹带过期时间的值，deadline 为零值表示永不过期
+type ttlEntry[V any] struct {
+	value    V
+	deadline time.Time
+}
+
+func (e ttlEntry[V]) expired(now time.Time) bool {
+	return !e.deadline.IsZero() && now.After(e.deadline)
+}
+
+// ttlOptions 收集 NewWithTTL 的功能性选项
+type ttlOptions[K comparable, V any] struct {
+	mapOpts       []Option[K, ttlEntry[V]]
+	sweepInterval time.Duration
+}
+
+// TTLOption 是传给 NewWithTTL 的功能性选项
+type TTLOption[K comparable, V any] func(*ttlOptions[K, V])
+
+// WithTTLShardCount 覆盖底层 Map 的分片数，用法与 WithShardCount 一致
+func WithTTLShardCount[K comparable, V any](shardCount int) TTLOption[K, V] {
+	return func(o *ttlOptions[K, V]) {
+		o.mapOpts = append(o.mapOpts, WithShardCount[K, ttlEntry[V]](shardCount))
+	}
+}
+
+// WithTTLHasher 替换底层 Map 的 Hasher，用法与 WithHasher 一致
+func WithTTLHasher[K comparable, V any](hasher Hasher[K]) TTLOption[K, V] {
+	return func(o *ttlOptions[K, V]) {
+		o.mapOpts = append(o.mapOpts, WithHasher[K, ttlEntry[V]](hasher))
+	}
+}
+
+// WithSweepInterval 覆盖后台清扫 goroutine 的扫描间隔，默认 1 分钟
+func WithSweepInterval[K comparable, V any](interval time.Duration) TTLOption[K, V] {
+	return func(o *ttlOptions[K, V]) {
+		o.sweepInterval = interval
+	}
+}
+
+// TTLMap字段名首字母均小写，避免外部使用时跳过NewWithTTL()函数使用结构体创建对象
+// TTLMap 在 Map 之上附加了一个按固定间隔运行的后台清扫 goroutine，把它变成
+// 一个可直接用作进程内缓存的结构：过期的 key 在被 GetWithTTL 命中时惰性删除，
+// 也会被清扫 goroutine 定期批量清理，不依赖调用方主动触碰过期 key。
+type TTLMap[K comparable, V any] struct {
+	m        *Map[K, ttlEntry[V]]
+	interval time.Duration
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewWithTTL 创建一个带 TTL 的并发安全 Map，并启动后台清扫 goroutine。
+// 用完后必须调用 Close 停止该 goroutine。
+func NewWithTTL[K comparable, V any](opts ...TTLOption[K, V]) *TTLMap[K, V] {
+	o := ttlOptions[K, V]{sweepInterval: defaultSweepInterval}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	tm := &TTLMap[K, V]{
+		m:        New[K, ttlEntry[V]](o.mapOpts...),
+		interval: o.sweepInterval,
+		stopCh:   make(chan struct{}),
+	}
+	tm.wg.Add(1)
+	go tm.sweepLoop()
+	return tm
+}
+
+// SetWithTTL 写入 key 对应的值，ttl <= 0 表示永不过期
+func (tm *TTLMap[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	var deadline time.Time
+	if ttl > 0 {
+		deadline = time.Now().Add(ttl)
+	}
+	tm.m.Set(key, ttlEntry[V]{value: value, deadline: deadline})
+}
+
+// GetWithTTL 读取 key 对应的值；已过期的 entry 视为不存在，并借助 DeleteIf
+// 惰性删除（重新校验过期状态，避免误删并发写入的新值）
+func (tm *TTLMap[K, V]) GetWithTTL(key K) (V, bool) {
+	e, ok := tm.m.Get(key)
+	if !ok || e.expired(time.Now()) {
+		if ok {
+			tm.m.DeleteIf(key, func(cur ttlEntry[V]) bool {
+				return cur.expired(time.Now())
+			})
+		}
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// Close 停止后台清扫 goroutine，可安全多次调用
+func (tm *TTLMap[K, V]) Close() {
+	tm.stopOnce.Do(func() {
+		close(tm.stopCh)
+	})
+	tm.wg.Wait()
+}
+
+func (tm *TTLMap[K, V]) sweepLoop() {
+	defer tm.wg.Done()
+	ticker := time.NewTicker(tm.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tm.stopCh:
+			return
+		case <-ticker.C:
+			tm.sweepOnce()
+		}
+	}
+}
+
+// sweepOnce 复用 Prune 的逐分片加读锁遍历，一次只锁住一个分片，不会让一次
+// 全量清扫卡住整个 Map 的写入者
+func (tm *TTLMap[K, V]) sweepOnce() {
+	now := time.Now()
+	_, _, _ = tm.m.Prune(func(_ K, value ttlEntry[V]) (bool, error) {
+		return value.expired(now), nil
+	})
+}
@@ -0,0 +1,40 @@
+package hmap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLMap_ExpiryAndSweep(t *testing.T) {
+	tm := NewWithTTL[string, int](WithSweepInterval[string, int](20 * time.Millisecond))
+	defer tm.Close()
+
+	tm.SetWithTTL("a", 1, 30*time.Millisecond)
+	tm.SetWithTTL("b", 2, 0) // 0 表示永不过期
+	// c 不经 GetWithTTL 读取，过期后只能由后台清扫删除
+	tm.SetWithTTL("c", 3, 30*time.Millisecond)
+
+	if v, ok := tm.GetWithTTL("a"); !ok || v != 1 {
+		t.Fatalf("a got %v %v", v, ok)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := tm.GetWithTTL("a"); ok {
+		t.Fatal("a should have expired")
+	}
+	if v, ok := tm.GetWithTTL("b"); !ok || v != 2 {
+		t.Fatalf("b got %v %v", v, ok)
+	}
+
+	// 给后台清扫 goroutine 一点时间把过期 key 真正从底层 Map 中清除
+	time.Sleep(50 * time.Millisecond)
+	if got := tm.m.Len(); got != 1 {
+		t.Fatalf("expected sweeper to have pruned the expired key, len=%d", got)
+	}
+}
+
+func TestTTLMap_CloseIsIdempotent(t *testing.T) {
+	tm := NewWithTTL[string, int](WithSweepInterval[string, int](5 * time.Millisecond))
+	tm.Close()
+	tm.Close()
+}